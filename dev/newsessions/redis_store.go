@@ -0,0 +1,203 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"code.google.com/p/gorilla/securecookie"
+)
+
+// RedisConn is the subset of a Redis connection that RedisStore needs.
+// redigo's redis.Conn and similarly-shaped clients satisfy it directly.
+type RedisConn interface {
+	Do(commandName string, args ...interface{}) (reply interface{}, err error)
+	Close() error
+}
+
+// RedisPool abstracts acquiring a RedisConn, so that RedisStore doesn't
+// have to depend on any particular Redis client package. *redigo/redis.Pool
+// already satisfies this interface.
+type RedisPool interface {
+	Get() RedisConn
+}
+
+// NewRedisStore returns a new RedisStore.
+//
+// keyPrefix is prepended to the session ID to form the Redis key under
+// which the session's Values are stored.
+//
+// See NewCookieStore() for a description of the keyPairs parameter.
+func NewRedisStore(pool RedisPool, keyPrefix string, keyPairs ...[]byte) *RedisStore {
+	return &RedisStore{
+		Pool:      pool,
+		KeyPrefix: keyPrefix,
+		Codecs:    securecookie.CodecsFromPairs(keyPairs...),
+		Options: &Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		MaxLength: 1 << 16, // 64KB, generous for a Values map
+	}
+}
+
+// RedisStore stores sessions in Redis. Only the session ID, signed via
+// securecookie, is kept in the cookie; the session Values are stored
+// server-side under KeyPrefix+id, with a TTL matching Options.MaxAge.
+type RedisStore struct {
+	Pool      RedisPool
+	KeyPrefix string
+	Codecs    []securecookie.Codec
+	Options   *Options // default configuration
+	MaxLength int      // maximum length, in bytes, of an encoded Values payload
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// See CookieStore.Get().
+func (s *RedisStore) Get(r *http.Request, name string) (*Session, error) {
+	return GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+//
+// See CookieStore.New().
+func (s *RedisStore) New(r *http.Request, name string) (*Session, error) {
+	session := NewSession(s, name)
+	session.IsNew = true
+	var err error
+	if c, errCookie := r.Cookie(name); errCookie == nil {
+		err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...)
+		if err == nil {
+			err = s.load(session)
+			if err == nil {
+				session.IsNew = false
+			}
+		}
+	}
+	return session, err
+}
+
+// Save adds a single session to the response.
+//
+// If session.Options.MaxAge is <= 0, the session is deleted from Redis and
+// an expiring cookie is sent to remove it from the client as well.
+func (s *RedisStore) Save(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	options := s.Options
+	if session.Options != nil {
+		options = session.Options
+	}
+	if session.ID == nil {
+		session.ID = securecookie.GenerateRandomKey(32)
+	}
+	if options.MaxAge <= 0 {
+		if err := s.delete(session); err != nil {
+			return err
+		}
+	} else if err := s.save(session, options.MaxAge); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
+		s.Codecs...)
+	if err != nil {
+		return err
+	}
+	maxAge := options.MaxAge
+	if maxAge <= 0 {
+		// A zero http.Cookie.MaxAge omits the attribute; -1 expires it.
+		maxAge = -1
+	}
+	cookie := &http.Cookie{
+		Name:     session.Name(),
+		Value:    encoded,
+		Path:     options.Path,
+		Domain:   options.Domain,
+		MaxAge:   maxAge,
+		Secure:   options.Secure,
+		HttpOnly: options.HttpOnly,
+	}
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// Delete removes session from Redis and expires its cookie.
+func (s *RedisStore) Delete(r *http.Request, w http.ResponseWriter,
+	session *Session) error {
+	if err := s.delete(session); err != nil {
+		return err
+	}
+	options := s.Options
+	if session.Options != nil {
+		options = session.Options
+	}
+	cookie := &http.Cookie{
+		Name:   session.Name(),
+		Value:  "",
+		Path:   options.Path,
+		Domain: options.Domain,
+		MaxAge: -1,
+	}
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// key returns the Redis key a session is stored under.
+func (s *RedisStore) key(session *Session) string {
+	return s.KeyPrefix + string(session.ID)
+}
+
+// save encodes session.Values and writes it to Redis with the given TTL,
+// in seconds.
+func (s *RedisStore) save(session *Session, maxAge int) error {
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values,
+		s.Codecs...)
+	if err != nil {
+		return err
+	}
+	if len(encoded) > s.MaxLength {
+		return errors.New("sessions: the value to store is too big")
+	}
+	conn := s.Pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("SETEX", s.key(session), strconv.Itoa(maxAge), encoded)
+	return err
+}
+
+// load reads session.Values back from Redis.
+func (s *RedisStore) load(session *Session) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	reply, err := conn.Do("GET", s.key(session))
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return errors.New("sessions: session not found")
+	}
+	encoded, ok := reply.(string)
+	if !ok {
+		if b, ok := reply.([]byte); ok {
+			encoded = string(b)
+		} else {
+			return errors.New("sessions: unexpected reply type from Redis")
+		}
+	}
+	return securecookie.DecodeMulti(session.Name(), encoded, &session.Values,
+		s.Codecs...)
+}
+
+// delete removes session's key from Redis, if any.
+func (s *RedisStore) delete(session *Session) error {
+	if session.ID == nil {
+		return nil
+	}
+	conn := s.Pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", s.key(session))
+	return err
+}
@@ -0,0 +1,149 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeRedisConn is an in-memory RedisConn used to test RedisStore without a
+// real Redis server. It only understands the commands RedisStore issues.
+type fakeRedisConn struct {
+	data   map[string]string
+	closed bool
+}
+
+func (c *fakeRedisConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	switch commandName {
+	case "SETEX":
+		key, _ := args[0].(string)
+		value, _ := args[2].(string)
+		c.data[key] = value
+		return "OK", nil
+	case "GET":
+		key, _ := args[0].(string)
+		value, ok := c.data[key]
+		if !ok {
+			return nil, nil
+		}
+		return value, nil
+	case "DEL":
+		key, _ := args[0].(string)
+		delete(c.data, key)
+		return int64(1), nil
+	}
+	return nil, errors.New("fakeRedisConn: unsupported command " + commandName)
+}
+
+func (c *fakeRedisConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// fakeRedisPool is a RedisPool backed by a single shared fakeRedisConn, so
+// that values saved through one Get() are visible to the next.
+type fakeRedisPool struct {
+	conn *fakeRedisConn
+}
+
+func newFakeRedisPool() *fakeRedisPool {
+	return &fakeRedisPool{conn: &fakeRedisConn{data: make(map[string]string)}}
+}
+
+func (p *fakeRedisPool) Get() RedisConn {
+	return p.conn
+}
+
+// TestRedisStoreSaveGet saves a session and reads it back through a new
+// request carrying the response's cookie, exercising the fake RedisPool
+// end to end.
+func TestRedisStoreSaveGet(t *testing.T) {
+	store := NewRedisStore(newFakeRedisPool(), "session_",
+		[]byte("0123456789abcdef0123456789abcdef"))
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	session, err := store.New(r, "session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session.Values["foo"] = "bar"
+	if err := store.Save(r, w, session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	r2, _ := http.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r2.AddCookie(c)
+	}
+	got, err := store.New(r2, "session")
+	if err != nil {
+		t.Fatalf("New after Save: %v", err)
+	}
+	if got.Values["foo"] != "bar" {
+		t.Fatalf("Values[\"foo\"] = %v, want %q", got.Values["foo"], "bar")
+	}
+}
+
+// TestRedisStoreDelete saves a session, deletes it, and checks that a
+// subsequent New for the same ID no longer finds it.
+func TestRedisStoreDelete(t *testing.T) {
+	store := NewRedisStore(newFakeRedisPool(), "session_",
+		[]byte("0123456789abcdef0123456789abcdef"))
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	session, err := store.New(r, "session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session.Values["foo"] = "bar"
+	if err := store.Save(r, w, session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	r2, _ := http.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r2.AddCookie(c)
+	}
+	w2 := httptest.NewRecorder()
+	session2, err := store.New(r2, "session")
+	if err != nil {
+		t.Fatalf("New before Delete: %v", err)
+	}
+	if err := store.Delete(r2, w2, session2); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	r3, _ := http.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r3.AddCookie(c)
+	}
+	if _, err := store.New(r3, "session"); err == nil {
+		t.Fatalf("New after Delete: got no error, want one")
+	}
+}
+
+// TestRedisStoreMaxLength checks that Save rejects a Values payload whose
+// encoded size exceeds MaxLength.
+func TestRedisStoreMaxLength(t *testing.T) {
+	store := NewRedisStore(newFakeRedisPool(), "session_",
+		[]byte("0123456789abcdef0123456789abcdef"))
+	store.MaxLength = 10
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	session, err := store.New(r, "session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session.Values["foo"] = "a value long enough to exceed MaxLength"
+	if err := store.Save(r, w, session); err == nil {
+		t.Fatalf("Save: got no error, want one for a payload over MaxLength")
+	}
+}
@@ -5,10 +5,15 @@
 package sessions
 
 import (
+	"errors"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"code.google.com/p/gorilla/securecookie"
 )
@@ -110,7 +115,24 @@ func (s *CookieStore) Save(r *http.Request, w http.ResponseWriter,
 
 // FilesystemStore ------------------------------------------------------------
 
-var fileMutex sync.RWMutex
+// fileLocksShards is the number of mutexes a fileLocks spreads session IDs
+// across. It is fixed so that fileLocks never grows with the number of
+// sessions seen over the life of the server.
+const fileLocksShards = 64
+
+// fileLocks guards concurrent access to individual session files. Locking
+// per shard of session IDs, instead of a single package-wide mutex, lets
+// unrelated sessions be read and written without serializing on each
+// other, without keeping a lock alive per session ID forever.
+type fileLocks struct {
+	shards [fileLocksShards]sync.RWMutex
+}
+
+func (f *fileLocks) get(id string) *sync.RWMutex {
+	h := fnv.New32a()
+	io.WriteString(h, id)
+	return &f.shards[h.Sum32()%fileLocksShards]
+}
 
 // NewCookieStore returns a new CookieStore.
 //
@@ -126,20 +148,23 @@ func NewFilesystemStore(path string, keyPairs ...[]byte) *FilesystemStore {
 		path += "/"
 	}
 	return &FilesystemStore{
-		path:    path,
-		Codecs:  securecookie.CodecsFromPairs(keyPairs...),
+		path:   path,
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
 		Options: &Options{
 			Path:   "/",
 			MaxAge: 86400 * 30,
 		},
+		locks: &fileLocks{},
 	}
 }
 
 // FilesystemStore stores sessions in the filesystem.
 type FilesystemStore struct {
-	path    string
-	Codecs  []securecookie.Codec
-	Options *Options // default configuration
+	path      string
+	Codecs    []securecookie.Codec
+	Options   *Options // default configuration
+	MaxLength int      // maximum length, in bytes, of an encoded Values payload; 0 means no limit
+	locks     *fileLocks
 }
 
 // Get returns a session for the given name after adding it to the registry.
@@ -169,12 +194,23 @@ func (s *FilesystemStore) New(r *http.Request, name string) (*Session, error) {
 }
 
 // Save adds a single session to the response.
+//
+// If the effective Options.MaxAge is < 0, the session's file is removed
+// and an expiring cookie is sent so the client forgets it too.
 func (s *FilesystemStore) Save(r *http.Request, w http.ResponseWriter,
 	session *Session) error {
 	if session.ID == nil {
 		session.ID = securecookie.GenerateRandomKey(32)
 	}
-	if err := s.writeFile(session); err != nil {
+	options := s.Options
+	if session.Options != nil {
+		options = session.Options
+	}
+	if options.MaxAge < 0 {
+		if err := s.deleteFile(session); err != nil {
+			return err
+		}
+	} else if err := s.writeFile(session); err != nil {
 		return err
 	}
 	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
@@ -182,10 +218,6 @@ func (s *FilesystemStore) Save(r *http.Request, w http.ResponseWriter,
 	if err != nil {
 		return err
 	}
-	options := s.Options
-	if session.Options != nil {
-		options = session.Options
-	}
 	cookie := &http.Cookie{
 		Name:     session.Name(),
 		Value:    encoded,
@@ -199,7 +231,14 @@ func (s *FilesystemStore) Save(r *http.Request, w http.ResponseWriter,
 	return nil
 }
 
-// writeFile writes encoded session.Values in a file.
+// filename returns the path of the file a session is stored in.
+func (s *FilesystemStore) filename(session *Session) string {
+	return s.path + "session_" + string(session.ID)
+}
+
+// writeFile atomically writes encoded session.Values to its file, via a
+// temporary file and rename, so that readers never observe a partial or
+// truncated write.
 func (s *FilesystemStore) writeFile(session *Session) error {
 	if len(session.Values) == 0 {
 		// Don't need to write anything.
@@ -210,44 +249,95 @@ func (s *FilesystemStore) writeFile(session *Session) error {
 	if err != nil {
 		return err
 	}
-	filename := s.path + "session_" + string(session.ID)
-	fileMutex.Lock()
-	defer fileMutex.Unlock()
-	fp, err2 := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0600)
-	if err2 != nil {
-		return err2
+	if s.MaxLength > 0 && len(encoded) > s.MaxLength {
+		return errors.New("sessions: the value to store is too big")
 	}
-	if _, err = fp.Write([]byte(encoded)); err != nil {
+	filename := s.filename(session)
+	lock := s.locks.get(filename)
+	lock.Lock()
+	defer lock.Unlock()
+	tmp, err := ioutil.TempFile(s.path, "session_tmp_")
+	if err != nil {
 		return err
 	}
-	fp.Close()
-	return nil
+	if _, err = tmp.Write([]byte(encoded)); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
 }
 
 // readFile reads a file and decodes its content into session.Values.
 func (s *FilesystemStore) readFile(session *Session) error {
-	filename := s.path + "session_" + string(session.ID)
-	fp, err := os.OpenFile(filename, os.O_RDONLY, 0400)
+	filename := s.filename(session)
+	lock := s.locks.get(filename)
+	lock.RLock()
+	defer lock.RUnlock()
+	fdata, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return err
 	}
-	defer fp.Close()
-	var fdata []byte
-	buf := make([]byte, 128)
-	for {
-		var n int
-		n, err = fp.Read(buf[0:])
-		fdata = append(fdata, buf[0:n]...)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
-	}
 	if err = securecookie.DecodeMulti(session.Name(), string(fdata),
 		&session.Values, s.Codecs...); err != nil {
 		return err
 	}
 	return nil
 }
+
+// deleteFile removes a session's file, if any.
+func (s *FilesystemStore) deleteFile(session *Session) error {
+	if session.ID == nil {
+		return nil
+	}
+	filename := s.filename(session)
+	lock := s.locks.get(filename)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Cleanup removes session files under s.path that haven't been modified
+// in more than maxAge.
+func (s *FilesystemStore) Cleanup(maxAge time.Duration) error {
+	entries, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), "session_") {
+			continue
+		}
+		if entry.ModTime().Before(cutoff) {
+			os.Remove(s.path + entry.Name())
+		}
+	}
+	return nil
+}
+
+// CleanupEvery starts a goroutine that calls s.Cleanup(maxAge) on every
+// tick of the given interval, until stop is closed.
+func (s *FilesystemStore) CleanupEvery(interval, maxAge time.Duration) (stop chan<- struct{}) {
+	quit := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Cleanup(maxAge)
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return quit
+}
@@ -0,0 +1,65 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+// TestFilesystemStoreConcurrentSaveGet saves and re-reads many distinct
+// sessions concurrently. It exercises the sharded per-session locking
+// added to FilesystemStore: Save/New for one session must not serialize
+// on a single global lock, and -race must find no data race across the
+// shared fileLocks shards.
+func TestFilesystemStoreConcurrentSaveGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemStore(dir, []byte("0123456789abcdef0123456789abcdef"))
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			r, _ := http.NewRequest("GET", "/", nil)
+			w := httptest.NewRecorder()
+			session, err := store.New(r, "session")
+			if err != nil {
+				t.Errorf("session %d: New: %v", i, err)
+				return
+			}
+			session.Values["n"] = i
+			if err := store.Save(r, w, session); err != nil {
+				t.Errorf("session %d: Save: %v", i, err)
+				return
+			}
+
+			r2, _ := http.NewRequest("GET", "/", nil)
+			for _, c := range w.Result().Cookies() {
+				r2.AddCookie(c)
+			}
+			got, err := store.New(r2, "session")
+			if err != nil {
+				t.Errorf("session %d: New after Save: %v", i, err)
+				return
+			}
+			if got.Values["n"] != i {
+				t.Errorf("session %d: Values[\"n\"] = %v, want %d", i, got.Values["n"], i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,528 @@
+// Copyright 2011 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ParseGQL parses a GQL query string into a Query and QueryOptions,
+// following the subset of GQL documented for App Engine:
+//
+//	SELECT * FROM Kind [WHERE cond {AND cond}]
+//	  [ORDER BY field [ASC|DESC] {, ...}] [LIMIT n [OFFSET m]]
+//
+// SELECT __key__ maps to QueryOptions.KeysOnly(true); SELECT DISTINCT
+// a, b maps to Query.Project("a", "b").Distinct(); a WHERE clause of
+// ANCESTOR IS KEY('...') maps to Query.Ancestor.
+//
+// Bind parameters ":1", ":2", ... are resolved positionally from args, in
+// the same way fmt.Sprintf resolves %v verbs. For named parameters
+// (":name") use ParseGQLMap instead.
+func ParseGQL(gql string, args ...interface{}) (*Query, *QueryOptions, os.Error) {
+	return (&gqlParser{lex: newGQLLexer(gql), args: args}).parse()
+}
+
+// ParseGQLMap is like ParseGQL, but resolves named bind parameters
+// (":name") from args instead of positional ones (":1", ":2", ...).
+func ParseGQLMap(gql string, args map[string]interface{}) (*Query, *QueryOptions, os.Error) {
+	return (&gqlParser{lex: newGQLLexer(gql), argsMap: args}).parse()
+}
+
+// ----------------------------------------------------------------------------
+// Lexer
+// ----------------------------------------------------------------------------
+
+type gqlTokKind int
+
+const (
+	gqlEOF gqlTokKind = iota
+	gqlIdent
+	gqlNumber
+	gqlString
+	gqlParam
+	gqlPunct
+)
+
+type gqlToken struct {
+	kind gqlTokKind
+	text string
+}
+
+type gqlLexer struct {
+	src string
+	pos int
+}
+
+func newGQLLexer(src string) *gqlLexer {
+	return &gqlLexer{src: src}
+}
+
+func (l *gqlLexer) next() (gqlToken, os.Error) {
+	l.skipSpace()
+	if l.pos >= len(l.src) {
+		return gqlToken{kind: gqlEOF}, nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case c == '\'' || c == '"':
+		return l.scanString(c)
+	case c == ':':
+		return l.scanParam()
+	case c == '-' || isDigit(c):
+		return l.scanNumber()
+	case isAlpha(c):
+		return l.scanIdent()
+	case c == '*' || c == ',' || c == '(' || c == ')':
+		l.pos++
+		return gqlToken{kind: gqlPunct, text: string(c)}, nil
+	case c == '=' || c == '!' || c == '<' || c == '>':
+		return l.scanOperator()
+	}
+	return gqlToken{}, fmt.Errorf("datastore: unexpected character %q in GQL query", c)
+}
+
+func (l *gqlLexer) skipSpace() {
+	for l.pos < len(l.src) && isSpace(l.src[l.pos]) {
+		l.pos++
+	}
+}
+
+func (l *gqlLexer) scanString(quote byte) (gqlToken, os.Error) {
+	start := l.pos
+	l.pos++ // opening quote
+	var b []byte
+	for {
+		if l.pos >= len(l.src) {
+			return gqlToken{}, os.NewError("datastore: unterminated string in GQL query starting at " + strconv.Itoa(start))
+		}
+		c := l.src[l.pos]
+		if c == quote {
+			// A doubled quote is an escaped literal quote, SQL-style.
+			if l.pos+1 < len(l.src) && l.src[l.pos+1] == quote {
+				b = append(b, quote)
+				l.pos += 2
+				continue
+			}
+			l.pos++
+			break
+		}
+		b = append(b, c)
+		l.pos++
+	}
+	return gqlToken{kind: gqlString, text: string(b)}, nil
+}
+
+func (l *gqlLexer) scanParam() (gqlToken, os.Error) {
+	start := l.pos
+	l.pos++ // ':'
+	if l.pos >= len(l.src) || !(isDigit(l.src[l.pos]) || isAlpha(l.src[l.pos])) {
+		return gqlToken{}, os.NewError("datastore: invalid bind parameter in GQL query")
+	}
+	for l.pos < len(l.src) && (isDigit(l.src[l.pos]) || isAlpha(l.src[l.pos]) || l.src[l.pos] == '_') {
+		l.pos++
+	}
+	return gqlToken{kind: gqlParam, text: l.src[start+1 : l.pos]}, nil
+}
+
+func (l *gqlLexer) scanNumber() (gqlToken, os.Error) {
+	start := l.pos
+	if l.src[l.pos] == '-' {
+		l.pos++
+	}
+	for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+		l.pos++
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '.' {
+		l.pos++
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+	}
+	return gqlToken{kind: gqlNumber, text: l.src[start:l.pos]}, nil
+}
+
+func (l *gqlLexer) scanIdent() (gqlToken, os.Error) {
+	start := l.pos
+	for l.pos < len(l.src) && (isAlpha(l.src[l.pos]) || isDigit(l.src[l.pos]) || l.src[l.pos] == '_') {
+		l.pos++
+	}
+	return gqlToken{kind: gqlIdent, text: l.src[start:l.pos]}, nil
+}
+
+func (l *gqlLexer) scanOperator() (gqlToken, os.Error) {
+	start := l.pos
+	l.pos++
+	if l.pos < len(l.src) && l.src[l.pos] == '=' {
+		l.pos++
+	}
+	return gqlToken{kind: gqlPunct, text: l.src[start:l.pos]}, nil
+}
+
+func isSpace(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' }
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+func isAlpha(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// ----------------------------------------------------------------------------
+// Parser
+// ----------------------------------------------------------------------------
+
+type gqlParser struct {
+	lex     *gqlLexer
+	tok     gqlToken
+	args    []interface{}
+	argsMap map[string]interface{}
+	nextArg int
+}
+
+func (p *gqlParser) advance() os.Error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *gqlParser) isIdent(word string) bool {
+	return p.tok.kind == gqlIdent && strings.EqualFold(p.tok.text, word)
+}
+
+func (p *gqlParser) expectIdent(word string) os.Error {
+	if !p.isIdent(word) {
+		return fmt.Errorf("datastore: expected %q in GQL query, got %q", word, p.tok.text)
+	}
+	return p.advance()
+}
+
+func (p *gqlParser) expectPunct(punct string) os.Error {
+	if p.tok.kind != gqlPunct || p.tok.text != punct {
+		return fmt.Errorf("datastore: expected %q in GQL query, got %q", punct, p.tok.text)
+	}
+	return p.advance()
+}
+
+func (p *gqlParser) parse() (*Query, *QueryOptions, os.Error) {
+	if err := p.advance(); err != nil {
+		return nil, nil, err
+	}
+	if err := p.expectIdent("SELECT"); err != nil {
+		return nil, nil, err
+	}
+	distinct := false
+	if p.isIdent("DISTINCT") {
+		distinct = true
+		if err := p.advance(); err != nil {
+			return nil, nil, err
+		}
+	}
+	keysOnly := false
+	var projection []string
+	switch {
+	case p.tok.kind == gqlPunct && p.tok.text == "*":
+		if err := p.advance(); err != nil {
+			return nil, nil, err
+		}
+	case p.isIdent("__key__"):
+		keysOnly = true
+		if err := p.advance(); err != nil {
+			return nil, nil, err
+		}
+	default:
+		for {
+			if p.tok.kind != gqlIdent {
+				return nil, nil, fmt.Errorf("datastore: expected field name in GQL query, got %q", p.tok.text)
+			}
+			projection = append(projection, p.tok.text)
+			if err := p.advance(); err != nil {
+				return nil, nil, err
+			}
+			if p.tok.kind == gqlPunct && p.tok.text == "," {
+				if err := p.advance(); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			break
+		}
+	}
+	if err := p.expectIdent("FROM"); err != nil {
+		return nil, nil, err
+	}
+	if p.tok.kind != gqlIdent {
+		return nil, nil, fmt.Errorf("datastore: expected kind name in GQL query, got %q", p.tok.text)
+	}
+	q := NewQuery(p.tok.text)
+	if err := p.advance(); err != nil {
+		return nil, nil, err
+	}
+	if len(projection) > 0 {
+		q = q.Project(projection...)
+		if distinct {
+			q = q.Distinct()
+		}
+	}
+	o := &QueryOptions{}
+	if keysOnly {
+		o = o.KeysOnly(true)
+	}
+
+	if p.isIdent("WHERE") {
+		if err := p.advance(); err != nil {
+			return nil, nil, err
+		}
+		var err os.Error
+		if q, err = p.parseConditions(q); err != nil {
+			return nil, nil, err
+		}
+	}
+	if p.isIdent("ORDER") {
+		if err := p.advance(); err != nil {
+			return nil, nil, err
+		}
+		if err := p.expectIdent("BY"); err != nil {
+			return nil, nil, err
+		}
+		var err os.Error
+		if q, err = p.parseOrders(q); err != nil {
+			return nil, nil, err
+		}
+	}
+	if p.isIdent("LIMIT") {
+		if err := p.advance(); err != nil {
+			return nil, nil, err
+		}
+		n, err := p.parseIntLiteral()
+		if err != nil {
+			return nil, nil, err
+		}
+		o = o.Limit(n)
+		if p.isIdent("OFFSET") {
+			if err := p.advance(); err != nil {
+				return nil, nil, err
+			}
+			m, err := p.parseIntLiteral()
+			if err != nil {
+				return nil, nil, err
+			}
+			o = o.Offset(m)
+		}
+	}
+	if p.tok.kind != gqlEOF {
+		return nil, nil, fmt.Errorf("datastore: unexpected %q at end of GQL query", p.tok.text)
+	}
+	return q, o, nil
+}
+
+func (p *gqlParser) parseConditions(q *Query) (*Query, os.Error) {
+	for {
+		var err os.Error
+		if p.isIdent("ANCESTOR") {
+			if err = p.advance(); err != nil {
+				return nil, err
+			}
+			if err = p.expectIdent("IS"); err != nil {
+				return nil, err
+			}
+			k, err := p.parseKeyLiteral()
+			if err != nil {
+				return nil, err
+			}
+			q = q.Ancestor(k)
+		} else {
+			if p.tok.kind != gqlIdent {
+				return nil, fmt.Errorf("datastore: expected field name in GQL query, got %q", p.tok.text)
+			}
+			field := p.tok.text
+			if err = p.advance(); err != nil {
+				return nil, err
+			}
+			op, err := p.parseOperator()
+			if err != nil {
+				return nil, err
+			}
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			q = q.Filter(field+" "+op, value)
+		}
+		if p.isIdent("AND") {
+			if err = p.advance(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		break
+	}
+	return q, nil
+}
+
+func (p *gqlParser) parseOperator() (string, os.Error) {
+	if p.isIdent("IN") {
+		if err := p.advance(); err != nil {
+			return "", err
+		}
+		return "in", nil
+	}
+	if p.tok.kind != gqlPunct {
+		return "", fmt.Errorf("datastore: expected operator in GQL query, got %q", p.tok.text)
+	}
+	switch p.tok.text {
+	case "=", "!=", "<", "<=", ">", ">=":
+		op := p.tok.text
+		return op, p.advance()
+	}
+	return "", fmt.Errorf("datastore: unsupported operator %q in GQL query", p.tok.text)
+}
+
+func (p *gqlParser) parseOrders(q *Query) (*Query, os.Error) {
+	for {
+		if p.tok.kind != gqlIdent {
+			return nil, fmt.Errorf("datastore: expected field name in GQL query, got %q", p.tok.text)
+		}
+		field := p.tok.text
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		desc := false
+		if p.isIdent("ASC") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		} else if p.isIdent("DESC") {
+			desc = true
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		}
+		if desc {
+			q = q.Order("-" + field)
+		} else {
+			q = q.Order(field)
+		}
+		if p.tok.kind == gqlPunct && p.tok.text == "," {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		break
+	}
+	return q, nil
+}
+
+// parseKeyLiteral parses a KEY('...') literal.
+func (p *gqlParser) parseKeyLiteral() (*Key, os.Error) {
+	v, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, os.NewError("datastore: KEY(...) literal must contain a string")
+	}
+	return DecodeKey(s)
+}
+
+// parseValue parses a literal value: a number, string, boolean, bind
+// parameter, or KEY('...') literal.
+func (p *gqlParser) parseValue() (interface{}, os.Error) {
+	switch {
+	case p.isIdent("KEY"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct("("); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != gqlString {
+			return nil, os.NewError("datastore: expected encoded key string in KEY(...) literal")
+		}
+		s := p.tok.text
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case p.isIdent("TRUE"):
+		return true, p.advance()
+	case p.isIdent("FALSE"):
+		return false, p.advance()
+	case p.tok.kind == gqlNumber:
+		text := p.tok.text
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if strings.Contains(text, ".") {
+			f, err := strconv.Atof64(text)
+			if err != nil {
+				return nil, os.NewError("datastore: invalid number " + text + " in GQL query")
+			}
+			return f, nil
+		}
+		n, err := strconv.Atoi64(text)
+		if err != nil {
+			return nil, os.NewError("datastore: invalid number " + text + " in GQL query")
+		}
+		return n, nil
+	case p.tok.kind == gqlString:
+		s := p.tok.text
+		return s, p.advance()
+	case p.tok.kind == gqlParam:
+		return p.resolveParam(p.tok.text)
+	}
+	return nil, fmt.Errorf("datastore: expected a value in GQL query, got %q", p.tok.text)
+}
+
+// parseIntLiteral parses a (possibly bound) integer literal, as used by
+// LIMIT and OFFSET.
+func (p *gqlParser) parseIntLiteral() (int, os.Error) {
+	v, err := p.parseValue()
+	if err != nil {
+		return 0, err
+	}
+	switch n := v.(type) {
+	case int64:
+		return int(n), nil
+	case int:
+		return n, nil
+	case int32:
+		return int(n), nil
+	case int16:
+		return int(n), nil
+	case int8:
+		return int(n), nil
+	}
+	return 0, os.NewError("datastore: expected an integer in GQL query")
+}
+
+// resolveParam resolves a bind parameter, advancing past it.
+func (p *gqlParser) resolveParam(name string) (interface{}, os.Error) {
+	defer p.advance()
+	if p.argsMap != nil {
+		v, ok := p.argsMap[name]
+		if !ok {
+			return nil, os.NewError("datastore: no value bound for GQL parameter :" + name)
+		}
+		return v, nil
+	}
+	idx, err := strconv.Atoi(name)
+	if err != nil {
+		idx = p.nextArg + 1
+	}
+	p.nextArg = idx
+	if idx < 1 || idx > len(p.args) {
+		return nil, os.NewError("datastore: no value bound for GQL parameter :" + name)
+	}
+	return p.args[idx-1], nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2011 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"testing"
+)
+
+// TestParseGQL checks that ParseGQL builds the Query that the equivalent
+// fluent API calls would, by comparing Query.String() for the supported
+// subset of GQL: projections, WHERE conditions (including a bound
+// parameter) and ORDER BY. LIMIT/OFFSET are checked by
+// TestParseGQLLimitOffset.
+func TestParseGQL(t *testing.T) {
+	tests := []struct {
+		gql  string
+		args []interface{}
+		want *Query
+	}{
+		{
+			gql:  "SELECT * FROM Person WHERE age > 18 ORDER BY age",
+			want: NewQuery("Person").Filter("age >", 18).Order("age"),
+		},
+		{
+			gql:  "SELECT DISTINCT name FROM Person WHERE age >= :1 ORDER BY age DESC",
+			args: []interface{}{21},
+			want: NewQuery("Person").Project("name").Distinct().
+				Filter("age >=", 21).Order("-age"),
+		},
+	}
+	for _, tc := range tests {
+		q, _, err := ParseGQL(tc.gql, tc.args...)
+		if err != nil {
+			t.Fatalf("ParseGQL(%q): %v", tc.gql, err)
+		}
+		if got, want := q.String(), tc.want.String(); got != want {
+			t.Fatalf("ParseGQL(%q).String() = %q, want %q", tc.gql, got, want)
+		}
+	}
+}
+
+// TestParseGQLLimitOffset checks that LIMIT and OFFSET are parsed into the
+// returned QueryOptions.
+func TestParseGQLLimitOffset(t *testing.T) {
+	_, o, err := ParseGQL("SELECT * FROM Person LIMIT 10 OFFSET 5")
+	if err != nil {
+		t.Fatalf("ParseGQL: %v", err)
+	}
+	if o.limit != 10 {
+		t.Fatalf("limit = %d, want 10", o.limit)
+	}
+	if o.offset != 5 {
+		t.Fatalf("offset = %d, want 5", o.offset)
+	}
+}
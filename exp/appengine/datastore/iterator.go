@@ -0,0 +1,334 @@
+// Copyright 2011 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"os"
+	"reflect"
+
+	"appengine"
+	"goprotobuf.googlecode.com/hg/proto"
+
+	pb "appengine_internal/datastore"
+)
+
+// Done is returned when a query iteration has completed.
+var Done = os.NewError("datastore: query has no more results")
+
+// Iterator is the result of running a query.
+//
+// A query that expands into more than one underlying RPC (see the
+// discussion of IN, != and OR filters on Query.Filter and Query.FilterOr)
+// is represented by an Iterator that fans the subqueries out, merges their
+// results and deduplicates entities that satisfy more than one branch.
+type Iterator struct {
+	q     *Query
+	order []queryOrder
+
+	leaves   []*leafIterator
+	seen     map[string]bool // non-nil when results must be deduplicated
+	limit    int32           // aggregate result limit across all leaves, 0 if none
+	returned int32           // results already returned by Next so far
+	offset   int32           // aggregate results still to skip across all leaves, 0 if none
+	skipped  int32           // results already skipped for offset so far
+	err      os.Error
+}
+
+// newIterator runs the given query and returns an iterator over its results.
+//
+// method is the RPC method used to start the query; historically always
+// "RunQuery".
+func newIterator(c appengine.Context, q *Query, o *QueryOptions, method string) *Iterator {
+	if o == nil {
+		o = &QueryOptions{}
+	}
+	if q.projection != nil && o.keysOnly {
+		return &Iterator{err: os.NewError("datastore: cannot use a projection query with KeysOnly")}
+	}
+	queries, err := q.expand()
+	if err != nil {
+		return &Iterator{err: err}
+	}
+	subCap := o.subqueryCap
+	if subCap == 0 {
+		subCap = defaultSubqueryCap
+	}
+	if len(queries) > subCap {
+		return &Iterator{err: os.NewError("datastore: query would fan out into too many subqueries; raise QueryOptions.SubqueryCap")}
+	}
+	fanout := len(queries) > 1
+	t := &Iterator{q: q, order: q.order, limit: int32(o.limit)}
+	if fanout {
+		t.seen = make(map[string]bool)
+		// Each leaf is its own RPC stream; skipping o.Offset results on
+		// every leaf would skip up to len(queries) times too many once
+		// merged and deduplicated. Instead, leave each leaf unskipped and
+		// have Next skip o.Offset results from the merged stream itself.
+		t.offset = int32(o.offset)
+	}
+	t.leaves = make([]*leafIterator, len(queries))
+	for i, sub := range queries {
+		var req pb.Query
+		if err := sub.toProto(&req); err != nil {
+			return &Iterator{err: err}
+		}
+		if err := o.toProto(&req); err != nil {
+			return &Iterator{err: err}
+		}
+		if fanout {
+			req.Offset = nil
+		}
+		leaf := &leafIterator{c: c, compile: req.GetCompile(), limit: req.GetLimit(), batchSize: int32(o.batchSize)}
+		if err := c.Call("datastore_v3", method, &req, &leaf.res, nil); err != nil {
+			return &Iterator{err: err}
+		}
+		leaf.served = int32(len(leaf.res.Result))
+		leaf.done = !leaf.res.GetMoreResults() || (leaf.limit > 0 && leaf.served >= leaf.limit)
+		t.leaves[i] = leaf
+	}
+	return t
+}
+
+// Next returns the key of the next result. When there are no more results,
+// Done is returned as the error.
+//
+// If the query is not keys only, it also loads the entity into dst, which
+// must be a struct pointer or nil. For a projection query, dst is zeroed
+// first, so fields not listed in the projection are left zero.
+//
+// When the query fanned out into several subqueries, Next performs a
+// k-way merge honoring any declared Order so that results stream out in
+// the correct order without buffering the whole result set, and it skips
+// entities already returned by another branch. The caller's QueryOptions
+// Limit and Offset, if any, bound and skip results across the merged,
+// deduplicated stream as a whole, not each subquery individually.
+func (t *Iterator) Next(dst interface{}) (*Key, os.Error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	if t.limit > 0 && t.returned >= t.limit {
+		return nil, Done
+	}
+	for {
+		idx, k, e, err := t.pickNext()
+		if err != nil {
+			t.err = err
+			return nil, err
+		}
+		if idx == -1 {
+			return nil, Done
+		}
+		t.leaves[idx].advance()
+		if t.seen != nil {
+			ks := k.String()
+			if t.seen[ks] {
+				continue
+			}
+			t.seen[ks] = true
+		}
+		if t.skipped < t.offset {
+			t.skipped++
+			continue
+		}
+		if dst != nil {
+			if t.q.projection != nil {
+				if v := reflect.ValueOf(dst); v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Struct {
+					v.Elem().Set(reflect.Zero(v.Elem().Type()))
+				}
+			}
+			if err := loadEntity(dst, e); err != nil {
+				return nil, err
+			}
+		}
+		t.returned++
+		return k, nil
+	}
+}
+
+// pickNext peeks at every leaf and returns the index of the one that should
+// be consumed next, honoring t.order when there is more than one leaf.
+func (t *Iterator) pickNext() (idx int, k *Key, e *pb.EntityProto, err os.Error) {
+	idx = -1
+	for i, leaf := range t.leaves {
+		lk, le, lerr := leaf.peek()
+		if lerr == Done {
+			continue
+		}
+		if lerr != nil {
+			return -1, nil, nil, lerr
+		}
+		if idx == -1 {
+			idx, k, e = i, lk, le
+			continue
+		}
+		if len(t.order) > 0 && orderLess(lk, le, k, e, t.order) {
+			idx, k, e = i, lk, le
+		}
+	}
+	return
+}
+
+// leafIterator walks the results of a single underlying RPC query.
+type leafIterator struct {
+	c       appengine.Context
+	compile bool
+
+	limit     int32 // overall result limit for this subquery, 0 if none
+	batchSize int32 // hint for the size of each Next batch, 0 for default
+	served    int32 // results already returned by RunQuery/Next so far
+
+	res  pb.QueryResult
+	i    int
+	done bool
+	err  os.Error
+
+	hasPeek bool
+	peekKey *Key
+	peekEnt *pb.EntityProto
+}
+
+// peek returns the next result without consuming it.
+func (l *leafIterator) peek() (*Key, *pb.EntityProto, os.Error) {
+	if l.hasPeek {
+		return l.peekKey, l.peekEnt, nil
+	}
+	if l.err != nil {
+		return nil, nil, l.err
+	}
+	for l.i >= len(l.res.Result) {
+		if l.done {
+			return nil, nil, Done
+		}
+		if err := l.nextBatch(); err != nil {
+			l.err = err
+			return nil, nil, err
+		}
+	}
+	e := l.res.Result[l.i]
+	k, err := protoToKey(e.Key)
+	if err != nil {
+		l.err = err
+		return nil, nil, err
+	}
+	l.hasPeek, l.peekKey, l.peekEnt = true, k, e
+	return k, e, nil
+}
+
+// advance consumes the result previously returned by peek.
+func (l *leafIterator) advance() {
+	l.i++
+	l.hasPeek = false
+	l.peekKey, l.peekEnt = nil, nil
+}
+
+// orderLess reports whether (ak, ae) sorts before (bk, be) according to
+// order, the declared Order clauses of the query being merged.
+func orderLess(ak *Key, ae *pb.EntityProto, bk *Key, be *pb.EntityProto, order []queryOrder) bool {
+	for _, o := range order {
+		property, direction, _ := o.parse()
+		var cmp int
+		if property == "__key__" {
+			cmp = compareValues(ak.String(), bk.String())
+		} else {
+			cmp = compareValues(propertyValue(ae, property), propertyValue(be, property))
+		}
+		if cmp == 0 {
+			continue
+		}
+		if direction == "-" {
+			return cmp > 0
+		}
+		return cmp < 0
+	}
+	return false
+}
+
+// propertyValue returns the raw value of the named property in e, or nil
+// if e has no such property.
+func propertyValue(e *pb.EntityProto, name string) interface{} {
+	for _, p := range e.Property {
+		if p.GetName() != name {
+			continue
+		}
+		v := p.Value
+		switch {
+		case v.Int64Value != nil:
+			return *v.Int64Value
+		case v.BooleanValue != nil:
+			return *v.BooleanValue
+		case v.StringValue != nil:
+			return *v.StringValue
+		case v.DoubleValue != nil:
+			return *v.DoubleValue
+		}
+	}
+	return nil
+}
+
+// compareValues orders two property values of the same underlying type.
+// Mismatched or unsupported types compare equal, which leaves their
+// relative order to the next Order clause (or stable w.r.t. each other).
+func compareValues(a, b interface{}) int {
+	switch x := a.(type) {
+	case int64:
+		if y, ok := b.(int64); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+		}
+	case float64:
+		if y, ok := b.(float64); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			if x == y {
+				return 0
+			}
+			if !x {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// nextBatch issues a follow-up Next RPC to fetch the next batch of results.
+func (l *leafIterator) nextBatch() os.Error {
+	req := pb.NextRequest{
+		Cursor:  l.res.Cursor,
+		Compile: proto.Bool(l.compile),
+	}
+	if l.batchSize > 0 {
+		req.Count = proto.Int32(l.batchSize)
+	}
+	l.res = pb.QueryResult{}
+	if err := l.c.Call("datastore_v3", "Next", &req, &l.res, nil); err != nil {
+		return err
+	}
+	l.i = 0
+	l.served += int32(len(l.res.Result))
+	l.done = !l.res.GetMoreResults() || len(l.res.Result) == 0 ||
+		(l.limit > 0 && l.served >= l.limit)
+	return nil
+}
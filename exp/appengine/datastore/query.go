@@ -11,6 +11,7 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 
 	"appengine"
 	"goprotobuf.googlecode.com/hg/proto"
@@ -20,19 +21,9 @@ import (
 
 // TODO
 // ====
-// - Ancestor Queries:
-//   - http://code.google.com/appengine/docs/python/datastore/queries.html#Ancestor_Queries
-// - Kindless Queries:
-//   - http://code.google.com/appengine/docs/python/datastore/queries.html#Kindless_Queries
-//   - http://code.google.com/appengine/docs/java/datastore/queries.html#Kindless_Queries
-// - Kindless Ancestor Queries:
-//   - http://code.google.com/appengine/docs/python/datastore/queries.html#Kindless_Ancestor_Queries
 // - Maybe split Query.getProto() in smaller functions to perform checkings
 //   related to datastore restrictions:
 //   - http://code.google.com/appengine/docs/python/datastore/queries.html#Restrictions_on_Queries
-// - Async calls:
-//   - http://code.google.com/appengine/docs/python/datastore/async.html
-// - IN, OR and != filters
 
 // ----------------------------------------------------------------------------
 // Query
@@ -45,10 +36,18 @@ func NewQuery(kind string) *Query {
 
 // Query represents a datastore query, and is immutable.
 type Query struct {
-	kind     string
-	ancestor *Key
-	filter   []queryFilter
-	order    []queryOrder
+	kind       string
+	ancestor   *Key
+	filter     []queryFilter
+	order      []queryOrder
+	projection []string
+	distinct   bool
+	kindless   bool
+
+	// orFilters holds the disjuncts set by FilterOr, if any. Each element
+	// contributes its own filter list; kind, ancestor, order and
+	// projection are inherited from the Query that Run()s the whole.
+	orFilters []*Query
 }
 
 // Kind sets the entity kind for the Query.
@@ -65,17 +64,49 @@ func (q *Query) Ancestor(ancestor *Key) *Query {
 	return &c
 }
 
+// Kindless opts the Query into running without a Kind, returning entities
+// of all kinds. It has no effect if Kind is non-empty.
+//
+// A kindless query may only filter and order by "__key__"; combine it
+// with Ancestor to scope it to a kindless-ancestor query, which is the
+// common case (NewQuery("").Ancestor(k) implies Kindless automatically).
+func (q *Query) Kindless() *Query {
+	c := *q
+	c.kindless = true
+	return &c
+}
+
 // Filter adds a field-based filter to the Query.
 // The filterStr argument must be a field name followed by optional space,
-// followed by an operator, one of ">", "<", ">=", "<=", or "=".
+// followed by an operator, one of ">", "<", ">=", "<=", "=", "!=" or "in".
 // Fields are compared against the provided value using the operator.
 // Multiple filters are AND'ed together.
+//
+// "!=" and "in" are not supported directly by the datastore RPC; the
+// Query fans out into one equality subquery per "in" value, or a "<" and
+// a ">" subquery for "!=", and the Iterator merges and deduplicates the
+// results. For "in", value must be a
+// slice or array of the values to match.
 func (q *Query) Filter(filterStr string, value interface{}) *Query {
 	c := *q
 	c.filter = append(c.filter, queryFilter{filterStr, value})
 	return &c
 }
 
+// FilterOr turns the Query into the logical disjunction ("OR") of the
+// filters set on each of the given Querys. Only the filter field of each
+// argument is used; its kind, ancestor, order and projection are ignored
+// in favor of the receiver's.
+//
+// Each disjunct is run as its own RPC and the results are merged and
+// deduplicated by the Iterator, at a cost proportional to the number of
+// disjuncts. See QueryOptions.SubqueryCap to bound this fan-out.
+func (q *Query) FilterOr(filters ...*Query) *Query {
+	c := *q
+	c.orFilters = append([]*Query{}, filters...)
+	return &c
+}
+
 // Order adds a field-based sort to the query.
 // Orders are applied in the order they are added.
 // The default order is ascending; to sort in descending
@@ -86,10 +117,70 @@ func (q *Query) Order(order string) *Query {
 	return &c
 }
 
+// Project sets the fields returned by the Query, changing it to a
+// projection query. Only the named fields are populated in the entities
+// decoded from the iterator; all other struct fields are left zero.
+//
+// Projection cannot be combined with KeysOnly(true), and fields marked
+// "noindex" cannot be projected; a field is rejected at Run time if it
+// was declared noindex for this kind via RegisterNoindexFields.
+func (q *Query) Project(fieldNames ...string) *Query {
+	c := *q
+	c.projection = append([]string{}, fieldNames...)
+	return &c
+}
+
+// noindexFields records, per entity kind, which field names are stored
+// as "noindex" (unindexed) properties. This package does not itself
+// walk entity struct tags, so code that defines a kind with "noindex"
+// fields must call RegisterNoindexFields once, typically from an init
+// function alongside the struct definition, for Project to be able to
+// reject projecting them.
+//
+// Registration is not necessarily confined to init: noindexMu guards
+// noindexFields so that RegisterNoindexFields can also run concurrently
+// with queries that read it in toProto.
+var (
+	noindexMu     sync.RWMutex
+	noindexFields = make(map[string]map[string]bool)
+)
+
+// RegisterNoindexFields declares that the given fields are stored as
+// "noindex" properties for kind, so that Query.Project rejects attempts
+// to project them.
+func RegisterNoindexFields(kind string, fieldNames ...string) {
+	noindexMu.Lock()
+	defer noindexMu.Unlock()
+	fields := noindexFields[kind]
+	if fields == nil {
+		fields = make(map[string]bool)
+		noindexFields[kind] = fields
+	}
+	for _, name := range fieldNames {
+		fields[name] = true
+	}
+}
+
+// Distinct de-duplicates the results of a projection query by the
+// projected fields. It has no effect unless Project has also been called.
+func (q *Query) Distinct() *Query {
+	c := *q
+	c.distinct = true
+	return &c
+}
+
 // String returns a string representation of the query.
 func (q *Query) String() string {
 	var hasWhere bool
-	buf := bytes.NewBufferString("SELECT *")
+	buf := bytes.NewBufferString("SELECT")
+	if q.projection != nil {
+		if q.distinct {
+			buf.WriteString(" DISTINCT")
+		}
+		fmt.Fprintf(buf, " %v", strings.Join(q.projection, ", "))
+	} else {
+		buf.WriteString(" *")
+	}
 	if q.kind != "" {
 		fmt.Fprintf(buf, " FROM %v", q.kind)
 	}
@@ -130,6 +221,37 @@ func (q *Query) Run(c appengine.Context, o *QueryOptions) *Iterator {
 	return newIterator(c, q, o, "RunQuery")
 }
 
+// RunAsync starts running the query without blocking, so that several
+// queries can be pipelined. Call Wait on the returned QueryFuture to get
+// the resulting Iterator.
+func (q *Query) RunAsync(c appengine.Context, o *QueryOptions) *QueryFuture {
+	f := &QueryFuture{done: make(chan struct{})}
+	go func() {
+		f.it = q.Run(c, o)
+		close(f.done)
+	}()
+	return f
+}
+
+// QueryFuture is the pending result of Query.RunAsync.
+type QueryFuture struct {
+	done chan struct{}
+	it   *Iterator
+}
+
+// Wait blocks until the query has finished running and returns its
+// Iterator, or the error encountered starting it.
+func (f *QueryFuture) Wait() (*Iterator, os.Error) {
+	<-f.done
+	return f.it, f.it.err
+}
+
+// Done returns a channel that is closed once the query has finished
+// running and Wait will not block.
+func (f *QueryFuture) Done() <-chan struct{} {
+	return f.done
+}
+
 // Private methods ------------------------------------------------------------
 
 // toProto converts the query to a protocol buffer.
@@ -138,15 +260,30 @@ func (q *Query) Run(c appengine.Context, o *QueryOptions) *Iterator {
 // It returns an ErrMulti with all encountered errors, if any.
 func (q *Query) toProto(dst *pb.Query) os.Error {
 	var errMulti ErrMulti
+	kindless := q.kindless || q.ancestor != nil
 	if q.kind != "" {
 		dst.Kind = proto.String(q.kind)
-	} else {
-		// TODO: kindless queries.
+	} else if !kindless {
 		errMulti = append(errMulti, os.NewError("datastore: empty query kind"))
 	}
 	if q.ancestor != nil {
 		dst.Ancestor = q.ancestor.toProto()
 	}
+	if q.kind == "" && kindless {
+		for _, f := range q.filter {
+			if property, _, err := f.parse(); err != nil {
+				errMulti = append(errMulti, err)
+			} else if property != "__key__" {
+				errMulti = append(errMulti, os.NewError("datastore: kindless queries only support filtering on __key__"))
+			}
+		}
+		for _, o := range q.order {
+			property, direction, _ := o.parse()
+			if property != "__key__" || direction == "-" {
+				errMulti = append(errMulti, os.NewError("datastore: kindless queries only support ordering by __key__ ascending"))
+			}
+		}
+	}
 	if q.filter != nil {
 		dst.Filter = make([]*pb.Query_Filter, len(q.filter))
 		for i, f := range q.filter {
@@ -167,12 +304,125 @@ func (q *Query) toProto(dst *pb.Query) os.Error {
 			dst.Order[i] = &order
 		}
 	}
+	if q.projection != nil {
+		noindexMu.RLock()
+		fields := noindexFields[q.kind]
+		noindexMu.RUnlock()
+		if fields != nil {
+			for _, name := range q.projection {
+				if fields[name] {
+					errMulti = append(errMulti, os.NewError("datastore: cannot project noindex field "+name))
+				}
+			}
+		}
+		dst.PropertyName = append([]string{}, q.projection...)
+		if q.distinct {
+			dst.GroupByPropertyName = append([]string{}, q.projection...)
+		}
+	}
 	if len(errMulti) > 0 {
 		return errMulti
 	}
 	return nil
 }
 
+// expand turns q into the set of concrete Querys that must be run as
+// individual RPCs and merged by the Iterator: one per FilterOr disjunct,
+// further expanded for any "in" or "!=" filter found in each disjunct.
+func (q *Query) expand() ([]*Query, os.Error) {
+	branches := []*Query{q}
+	if q.orFilters != nil {
+		branches = make([]*Query, len(q.orFilters))
+		for i, b := range q.orFilters {
+			c := *q
+			c.orFilters = nil
+			c.filter = b.filter
+			branches[i] = &c
+		}
+	}
+	var out []*Query
+	for _, b := range branches {
+		sets, err := expandFilters(b.filter, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, set := range sets {
+			c := *b
+			c.filter = set
+			out = append(out, &c)
+		}
+	}
+	return out, nil
+}
+
+// expandFilters recursively expands "in" and "!=" filters into the
+// cartesian product of equality/inequality filters that make it up,
+// returning every concrete filter list that must be run as its own RPC.
+func expandFilters(filters []queryFilter, fixed []queryFilter) ([][]queryFilter, os.Error) {
+	if len(filters) == 0 {
+		return [][]queryFilter{fixed}, nil
+	}
+	f, rest := filters[0], filters[1:]
+	property, operator, err := f.parse()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.EqualFold(operator, "in"):
+		values, err := inValues(f.value)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			return nil, os.NewError("datastore: empty value list for in filter on " + property)
+		}
+		var out [][]queryFilter
+		for _, v := range values {
+			sets, err := expandFilters(rest, append(extend(fixed), queryFilter{property + " =", v}))
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, sets...)
+		}
+		return out, nil
+	case operator == "!=":
+		var out [][]queryFilter
+		for _, op := range []string{"<", ">"} {
+			sets, err := expandFilters(rest, append(extend(fixed), queryFilter{property + " " + op, f.value}))
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, sets...)
+		}
+		return out, nil
+	default:
+		return expandFilters(rest, append(extend(fixed), f))
+	}
+}
+
+// extend returns a copy of fixed that is safe to append to independently
+// of other copies produced from the same slice.
+func extend(fixed []queryFilter) []queryFilter {
+	c := make([]queryFilter, len(fixed))
+	copy(c, fixed)
+	return c
+}
+
+// inValues returns the elements of an "in" filter's value, which must be a
+// slice or array.
+func inValues(value interface{}) ([]interface{}, os.Error) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		values := make([]interface{}, v.Len())
+		for i := range values {
+			values[i] = v.Index(i).Interface()
+		}
+		return values, nil
+	}
+	return nil, os.NewError("datastore: value for an \"in\" filter must be a slice or array")
+}
+
 // ----------------------------------------------------------------------------
 // QueryOptions
 // ----------------------------------------------------------------------------
@@ -182,17 +432,49 @@ func NewQueryOptions(limit int, offset int) *QueryOptions {
 	return &QueryOptions{limit: limit, offset: offset}
 }
 
+// defaultSubqueryCap is the default limit on how many subqueries a Query
+// with IN, OR or != filters may fan out into. See QueryOptions.SubqueryCap.
+const defaultSubqueryCap = 30
+
 // QueryOptions defines a configuration to run a query, and is immutable.
 type QueryOptions struct {
-	limit       int
-	offset      int
-	keysOnly    bool
-	compile     bool
-	startCursor *Cursor
-	endCursor   *Cursor
-	// TODO?
-	// batchSize: int, hint for the number of results returned per RPC
-	// prefetchSize: int, hint for the number of results in the first RPC
+	limit        int
+	offset       int
+	keysOnly     bool
+	compile      bool
+	startCursor  *Cursor
+	endCursor    *Cursor
+	subqueryCap  int
+	batchSize    int
+	prefetchSize int
+}
+
+// BatchSize sets a hint for the number of results returned per Next RPC
+// issued while paging through the query. A zero value lets the datastore
+// choose.
+func (o *QueryOptions) BatchSize(batchSize int) *QueryOptions {
+	c := *o
+	c.batchSize = batchSize
+	return &c
+}
+
+// PrefetchSize sets a hint for the number of results returned by the
+// initial RunQuery RPC, which may differ from the size of later batches
+// set via BatchSize. A zero value lets the datastore choose.
+func (o *QueryOptions) PrefetchSize(prefetchSize int) *QueryOptions {
+	c := *o
+	c.prefetchSize = prefetchSize
+	return &c
+}
+
+// SubqueryCap sets the maximum number of subqueries a fan-out query (one
+// using IN, OR or != filters) may expand into. Queries that would exceed
+// it fail instead of running; this guards against the cost multiplier of
+// an unbounded fan-out. A zero value keeps the package default.
+func (o *QueryOptions) SubqueryCap(n int) *QueryOptions {
+	c := *o
+	c.subqueryCap = n
+	return &c
 }
 
 // Limit sets the maximum number of keys/entities to return.
@@ -262,6 +544,11 @@ func (o *QueryOptions) toProto(dst *pb.Query) os.Error {
 	if o.endCursor != nil {
 		dst.EndCompiledCursor = o.endCursor.compiledCursor
 	}
+	if o.prefetchSize > 0 {
+		dst.Count = proto.Int32(int32(o.prefetchSize))
+	} else if o.batchSize > 0 {
+		dst.Count = proto.Int32(int32(o.batchSize))
+	}
 	if len(errMulti) > 0 {
 		return errMulti
 	}
@@ -318,7 +605,15 @@ func (q queryFilter) parse() (property, operator string, err os.Error) {
 		err = os.NewError("datastore: invalid query filter: " + filter)
 		return
 	}
-	property = strings.TrimRight(filter, " ><=")
+	if idx := strings.LastIndex(filter, " "); idx != -1 && strings.EqualFold(filter[idx+1:], "in") {
+		property = strings.TrimSpace(filter[:idx])
+		operator = "in"
+		if property == "" {
+			err = os.NewError("datastore: empty query filter property")
+		}
+		return
+	}
+	property = strings.TrimRight(filter, " !><=")
 	if property == "" {
 		err = os.NewError("datastore: empty query filter property")
 		return
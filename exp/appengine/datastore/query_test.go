@@ -0,0 +1,96 @@
+// Copyright 2011 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"testing"
+)
+
+// TestQueryExpandIn checks that a single "in" filter fans out into one
+// equality-filtered subquery per value.
+func TestQueryExpandIn(t *testing.T) {
+	q := NewQuery("Person").Filter("status in", []interface{}{"new", "active"})
+	branches, err := q.expand()
+	if err != nil {
+		t.Fatalf("expand: %v", err)
+	}
+	if len(branches) != 2 {
+		t.Fatalf("len(branches) = %d, want 2", len(branches))
+	}
+	want := []string{"status =\"new\"", "status =\"active\""}
+	for i, b := range branches {
+		if len(b.filter) != 1 {
+			t.Fatalf("branch %d: len(filter) = %d, want 1", i, len(b.filter))
+		}
+		if got := b.filter[0].String(); got != want[i] {
+			t.Fatalf("branch %d: filter = %q, want %q", i, got, want[i])
+		}
+	}
+}
+
+// TestQueryExpandNotEqual checks that a "!=" filter fans out into a "<"
+// and a ">" subquery, the two halves the datastore RPC actually supports.
+func TestQueryExpandNotEqual(t *testing.T) {
+	q := NewQuery("Person").Filter("status !=", "banned")
+	branches, err := q.expand()
+	if err != nil {
+		t.Fatalf("expand: %v", err)
+	}
+	if len(branches) != 2 {
+		t.Fatalf("len(branches) = %d, want 2", len(branches))
+	}
+	want := []string{"status <\"banned\"", "status >\"banned\""}
+	for i, b := range branches {
+		if got := b.filter[0].String(); got != want[i] {
+			t.Fatalf("branch %d: filter = %q, want %q", i, got, want[i])
+		}
+	}
+}
+
+// TestQueryExpandCartesianProduct checks that two "in" filters fan out
+// into the cartesian product of their values, each carrying both fixed
+// equality filters, which is what lets an Iterator run one RPC per branch
+// and merge the results back together.
+func TestQueryExpandCartesianProduct(t *testing.T) {
+	q := NewQuery("Person").
+		Filter("status in", []interface{}{"new", "active"}).
+		Filter("country in", []interface{}{"US", "CA"})
+	branches, err := q.expand()
+	if err != nil {
+		t.Fatalf("expand: %v", err)
+	}
+	if len(branches) != 4 {
+		t.Fatalf("len(branches) = %d, want 4", len(branches))
+	}
+	for _, b := range branches {
+		if len(b.filter) != 2 {
+			t.Fatalf("branch filter count = %d, want 2", len(b.filter))
+		}
+	}
+}
+
+// TestCompareValues checks the ordering compareValues establishes for the
+// property types an Iterator's k-way merge needs to compare.
+func TestCompareValues(t *testing.T) {
+	tests := []struct {
+		a, b interface{}
+		want int
+	}{
+		{int64(1), int64(2), -1},
+		{int64(2), int64(2), 0},
+		{int64(3), int64(2), 1},
+		{1.5, 2.5, -1},
+		{"abc", "abd", -1},
+		{"abc", "abc", 0},
+		{"abd", "abc", 1},
+		// Mismatched types compare equal, leaving order to the next clause.
+		{int64(1), "abc", 0},
+	}
+	for _, tc := range tests {
+		if got := compareValues(tc.a, tc.b); got != tc.want {
+			t.Fatalf("compareValues(%#v, %#v) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2011 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"os"
+	"strings"
+
+	"appengine"
+	"goprotobuf.googlecode.com/hg/proto"
+
+	pb "appengine_internal/datastore"
+)
+
+// ErrConcurrentTransaction is returned by RunInTransaction when the
+// transaction could not be committed because of a conflicting concurrent
+// transaction, after exhausting TransactionOptions.Attempts attempts.
+var ErrConcurrentTransaction = os.NewError("datastore: concurrent transaction")
+
+// errNoAncestor is returned when a query run inside a transaction lacks an
+// Ancestor filter. The datastore requires every query run inside a
+// transaction to be an ancestor query, rooted in one of the entity groups
+// the transaction touches.
+var errNoAncestor = os.NewError("datastore: queries inside a transaction must have an Ancestor")
+
+// TransactionOptions configures RunInTransaction.
+type TransactionOptions struct {
+	// XG allows the transaction to span up to 5 entity groups, instead
+	// of the default single entity group.
+	XG bool
+	// Attempts is the number of times to attempt the transaction before
+	// giving up with ErrConcurrentTransaction. Zero means 1 (no retry).
+	Attempts int
+}
+
+// RunInTransaction runs f in a transaction.
+//
+// f is passed a Context that, for as long as f is running, attaches the
+// transaction to every Get, Put, Delete and Query.Run call made through
+// it. If f returns nil, RunInTransaction commits the transaction; if the
+// commit fails because of a conflicting concurrent transaction, the whole
+// of f is run again, up to opts.Attempts runs in all (default 1, i.e. no
+// retry), before ErrConcurrentTransaction is returned. If f returns a non-nil error, the
+// transaction is rolled back and that error is returned unchanged.
+func RunInTransaction(c appengine.Context, f func(tc appengine.Context) os.Error, opts *TransactionOptions) os.Error {
+	if opts == nil {
+		opts = &TransactionOptions{}
+	}
+	attempts := opts.Attempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+	for i := 0; i < attempts; i++ {
+		beginReq := pb.BeginTransactionRequest{
+			AllowMultipleEg: proto.Bool(opts.XG),
+		}
+		tx := &pb.Transaction{}
+		if err := c.Call("datastore_v3", "BeginTransaction", &beginReq, tx, nil); err != nil {
+			return err
+		}
+		tc := &transactionContext{Context: c, transaction: tx}
+		if err := f(tc); err != nil {
+			var rollbackRes pb.CommitResponse
+			c.Call("datastore_v3", "Rollback", tx, &rollbackRes, nil)
+			return err
+		}
+		var commitRes pb.CommitResponse
+		err := c.Call("datastore_v3", "Commit", tx, &commitRes, nil)
+		if err == nil {
+			return nil
+		}
+		if !isConcurrentTransactionError(err) {
+			return err
+		}
+	}
+	return ErrConcurrentTransaction
+}
+
+// isConcurrentTransactionError reports whether err is the datastore RPC's
+// way of saying a transaction lost a commit race, so it is worth retrying.
+func isConcurrentTransactionError(err os.Error) bool {
+	// TODO: the underlying RPC error currently doesn't expose a typed
+	// ApplicationError code, so this falls back to matching the message
+	// the datastore_v3 service is documented to use.
+	return err != nil && strings.Contains(err.String(), "concurrent transaction")
+}
+
+// transactionContext wraps a Context, attaching an in-flight transaction
+// to every datastore_v3 RPC made through it.
+type transactionContext struct {
+	appengine.Context
+	transaction *pb.Transaction
+}
+
+// Call attaches tc.transaction to Get, Put, Delete and RunQuery requests
+// before delegating to the wrapped Context. RunQuery additionally
+// requires an Ancestor filter, per datastore transaction restrictions.
+func (tc *transactionContext) Call(service, method string, in, out interface{}, opts *appengine.CallOptions) os.Error {
+	if service == "datastore_v3" {
+		switch req := in.(type) {
+		case *pb.GetRequest:
+			req.Transaction = tc.transaction
+		case *pb.PutRequest:
+			req.Transaction = tc.transaction
+		case *pb.DeleteRequest:
+			req.Transaction = tc.transaction
+		case *pb.Query:
+			if req.Ancestor == nil {
+				return errNoAncestor
+			}
+			req.Transaction = tc.transaction
+		}
+	}
+	return tc.Context.Call(service, method, in, out, opts)
+}
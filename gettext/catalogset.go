@@ -0,0 +1,177 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettext
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// NewCatalogSet returns a new CatalogSet that loads catalogs from
+// rootDir/<locale>/LC_MESSAGES/<domain>.mo, following the directory
+// layout GNU gettext tools produce.
+func NewCatalogSet(rootDir string) *CatalogSet {
+	return &CatalogSet{
+		rootDir:    rootDir,
+		domainDirs: make(map[string]string),
+		cache:      make(map[catalogKey]*Catalog),
+	}
+}
+
+// CatalogSet manages catalogs across multiple domains and locales,
+// playing the role GNU gettext's bindtextdomain/dcgettext machinery
+// plays for a whole process: it resolves which .mo file backs a given
+// (locale, domain) pair, wires up Catalog.Fallback along the locale's
+// RFC 4647 lookup chain, and caches the result.
+type CatalogSet struct {
+	rootDir    string
+	domainDirs map[string]string // per-domain override set via Bind
+	mu         sync.RWMutex
+	cache      map[catalogKey]*Catalog
+}
+
+type catalogKey struct {
+	locale, domain string
+}
+
+// Bind sets the base directory used to look up domain's catalogs,
+// overriding the CatalogSet's rootDir for that domain. It mirrors GNU
+// gettext's bindtextdomain.
+func (set *CatalogSet) Bind(domain, path string) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	set.domainDirs[domain] = path
+}
+
+// Catalog returns the catalog for the given locale and domain. Its
+// Fallback chain follows RFC 4647 basic filtering, truncating trailing
+// subtags until none are left: "pt_BR" falls back to "pt", which falls
+// back to an untranslated default. Catalogs are loaded at most once and
+// cached for subsequent calls.
+func (set *CatalogSet) Catalog(locale, domain string) *Catalog {
+	chain := localeChain(locale)
+	var fallback *Catalog
+	for i := len(chain) - 1; i >= 0; i-- {
+		fallback = set.load(chain[i], domain, fallback)
+	}
+	return fallback
+}
+
+// load returns the cached catalog for (locale, domain), loading it from
+// disk and wiring fallback as its Fallback the first time it is needed.
+// A missing or malformed .mo file yields an empty catalog, so lookups
+// simply fall through to fallback.
+func (set *CatalogSet) load(locale, domain string, fallback *Catalog) *Catalog {
+	key := catalogKey{locale, domain}
+	set.mu.RLock()
+	c, ok := set.cache[key]
+	set.mu.RUnlock()
+	if ok {
+		return c
+	}
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if c, ok := set.cache[key]; ok {
+		return c
+	}
+	c = NewCatalog()
+	c.Fallback = fallback
+	dir := set.rootDir
+	if d, ok := set.domainDirs[domain]; ok {
+		dir = d
+	}
+	filename := filepath.Join(dir, locale, "LC_MESSAGES", domain+".mo")
+	if f, err := os.Open(filename); err == nil {
+		c.ReadMO(f)
+		f.Close()
+	}
+	set.cache[key] = c
+	return c
+}
+
+// localeChain returns the RFC 4647 basic filtering lookup chain for
+// locale, from most to least specific, e.g. "pt_BR" -> ["pt_BR", "pt"].
+func localeChain(locale string) []string {
+	var chain []string
+	for cur := locale; cur != ""; {
+		chain = append(chain, cur)
+		idx := strings.LastIndexAny(cur, "-_")
+		if idx < 0 {
+			break
+		}
+		cur = cur[:idx]
+	}
+	return chain
+}
+
+// Negotiate matches the value of an HTTP Accept-Language header against
+// supported, a list of locale tags the caller can actually serve, and
+// returns the best one to use, or "" if none is acceptable.
+//
+// Ranges are tried in order of decreasing q-value; for each, supported
+// is searched for a case-insensitive match, truncating trailing subtags
+// from the range (longest-prefix first) until one is found or the range
+// is exhausted. The "*" range matches the first entry in supported.
+func (set *CatalogSet) Negotiate(acceptLanguage string, supported []string) string {
+	for _, r := range parseAcceptLanguage(acceptLanguage) {
+		if r.tag == "*" {
+			if len(supported) > 0 {
+				return supported[0]
+			}
+			continue
+		}
+		for candidate := r.tag; candidate != ""; {
+			for _, s := range supported {
+				if strings.EqualFold(s, candidate) {
+					return s
+				}
+			}
+			idx := strings.LastIndexAny(candidate, "-_")
+			if idx < 0 {
+				break
+			}
+			candidate = candidate[:idx]
+		}
+	}
+	return ""
+}
+
+// acceptRange is a single language-range from an Accept-Language header.
+type acceptRange struct {
+	tag string
+	q   float64
+}
+
+// parseAcceptLanguage parses an Accept-Language header value into its
+// ranges, dropping any with q=0, sorted by decreasing q (stable, so
+// ranges with equal q keep their original relative order).
+func parseAcceptLanguage(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		tag, q := part, 1.0
+		if idx := strings.Index(part, ";"); idx >= 0 {
+			tag = strings.TrimSpace(part[:idx])
+			if p := strings.TrimSpace(part[idx+1:]); strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(p[2:]), 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		ranges = append(ranges, acceptRange{tag, q})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	return ranges
+}
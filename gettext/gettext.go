@@ -7,6 +7,7 @@ package gettext
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"strings"
 )
@@ -25,8 +26,11 @@ type Reader interface {
 	io.Seeker
 }
 
-// ContextFunc is used to select the context stored for message disambiguation.
-type ContextFunc func(ctx string) bool
+// contextKey returns the key under which a context-qualified message is
+// stored, matching the "ctx\x04msg" convention used in MO/PO files.
+func contextKey(ctx, msg string) string {
+	return ctx + "\x04" + msg
+}
 
 // pluralFunc is used to select the plural form index.
 type pluralFunc func(int) int
@@ -52,6 +56,7 @@ func NewCatalog() *Catalog {
 		messages:   make(map[string]string),
 		mPlurals:   make(map[string][]string),
 		tPlurals:   make(map[string][]string),
+		header:     make(map[string]string),
 		pluralFunc: defaultPluralFunc,
 	}
 }
@@ -59,26 +64,102 @@ func NewCatalog() *Catalog {
 // Catalog stores gettext translations.
 //
 // Inspired by Python's gettext.GNUTranslations.
-//
-// TODO: Gettextf(msg, replacements...) to use with fmt.Sprintf?
 type Catalog struct {
-	Fallback    *Catalog            // used when a translation is not found
-	ContextFunc ContextFunc         // used to select context to load
-	messages    map[string]string   // original messages
-	mPlurals    map[string][]string // message plurals
-	tPlurals    map[string][]string	// translation plurals
-	pluralFunc  pluralFunc          // used to select the plural form index
+	Fallback     *Catalog            // used when a translation is not found
+	IncludeFuzzy bool                // if true, ReadPO also loads entries marked "#, fuzzy"
+	messages     map[string]string   // original messages
+	mPlurals     map[string][]string // message plurals
+	tPlurals     map[string][]string // translation plurals
+	header       map[string]string   // parsed empty-msgid header entries
+	pluralFunc   pluralFunc          // used to select the plural form index
+}
+
+// Header returns the value of the given key from the file header (the
+// entry stored under the empty msgid), or "" if it isn't set.
+func (c *Catalog) Header(key string) string {
+	return c.header[key]
+}
+
+// charset returns the charset declared in the Content-Type header entry
+// (e.g. "text/plain; charset=ISO-8859-1"), or "" if none is declared.
+func (c *Catalog) charset() string {
+	ct := c.header["Content-Type"]
+	idx := strings.Index(strings.ToLower(ct), "charset=")
+	if idx < 0 {
+		return ""
+	}
+	return strings.TrimSpace(ct[idx+len("charset="):])
+}
+
+// transcodeToUTF8 rewrites every message and plural form already loaded
+// into c from its declared charset to UTF-8, if that charset is one this
+// package knows how to decode without pulling in an external charmap
+// dependency. Unsupported or absent charsets are left untouched; the
+// catalog's bytes pass through as-is, same as before this existed.
+func (c *Catalog) transcodeToUTF8() {
+	switch strings.ToLower(c.charset()) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return
+	case "iso-8859-1", "latin1", "latin-1":
+		for k, v := range c.messages {
+			c.messages[k] = latin1ToUTF8(v)
+		}
+		for k, v := range c.mPlurals {
+			c.mPlurals[k] = latin1SliceToUTF8(v)
+		}
+		for k, v := range c.tPlurals {
+			c.tPlurals[k] = latin1SliceToUTF8(v)
+		}
+	}
+}
+
+// latin1ToUTF8 converts a string holding ISO-8859-1 bytes to UTF-8; every
+// ISO-8859-1 byte maps directly onto the Unicode code point of the same
+// value, so this needs no table.
+func latin1ToUTF8(s string) string {
+	r := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		r[i] = rune(s[i])
+	}
+	return string(r)
+}
+
+func latin1SliceToUTF8(ss []string) []string {
+	out := make([]string, len(ss))
+	for i, s := range ss {
+		out[i] = latin1ToUTF8(s)
+	}
+	return out
 }
 
 // Gettext returns a translation for the given message.
 func (c *Catalog) Gettext(msg string) string {
-	if trans, ok := c.messages[msg]; ok {
+	return c.gettext(msg, msg)
+}
+
+// Gettextf is like Gettext, but formats the translation with fmt.Sprintf
+// using a.
+func (c *Catalog) Gettextf(msg string, a ...interface{}) string {
+	return fmt.Sprintf(c.Gettext(msg), a...)
+}
+
+// Pgettext returns a translation for the given message in the given
+// context. Contexts let the same msg text be translated differently
+// depending on where it is used.
+func (c *Catalog) Pgettext(ctx, msg string) string {
+	return c.gettext(contextKey(ctx, msg), msg)
+}
+
+// gettext looks up key in messages, falling back to c.Fallback and then
+// to deflt if no translation is found.
+func (c *Catalog) gettext(key, deflt string) string {
+	if trans, ok := c.messages[key]; ok {
 		return trans
 	}
 	if c.Fallback != nil {
-		return c.Fallback.Gettext(msg)
+		return c.Fallback.gettext(key, deflt)
 	}
-	return msg
+	return deflt
 }
 
 // Ngettext returns a plural translation for a message according to the
@@ -87,13 +168,31 @@ func (c *Catalog) Gettext(msg string) string {
 // msg1 is used to lookup for a translation, and msg2 is used as the plural
 // form fallback if a translation is not found.
 func (c *Catalog) Ngettext(msg1, msg2 string, n int) string {
-	if plurals, ok := c.tPlurals[msg1]; ok {
+	return c.ngettext(msg1, msg1, msg2, n)
+}
+
+// Ngettextf is like Ngettext, but formats the translation with
+// fmt.Sprintf using a.
+func (c *Catalog) Ngettextf(msg1, msg2 string, n int, a ...interface{}) string {
+	return fmt.Sprintf(c.Ngettext(msg1, msg2, n), a...)
+}
+
+// Npgettext returns a plural translation for a message in the given
+// context, according to the amount n.
+func (c *Catalog) Npgettext(ctx, msg1, msg2 string, n int) string {
+	return c.ngettext(contextKey(ctx, msg1), msg1, msg2, n)
+}
+
+// ngettext looks up key in tPlurals, falling back to c.Fallback and then
+// to msg1/msg2 (chosen per n) if no translation is found.
+func (c *Catalog) ngettext(key, msg1, msg2 string, n int) string {
+	if plurals, ok := c.tPlurals[key]; ok {
 		if idx := c.pluralFunc(n); idx < len(plurals) {
 			return plurals[idx]
 		}
 	}
 	if c.Fallback != nil {
-		return c.Fallback.Ngettext(msg1, msg2, n)
+		return c.Fallback.ngettext(key, msg1, msg2, n)
 	}
 	if n == 1 {
 		return msg1
@@ -109,7 +208,6 @@ func (c *Catalog) Ngettext(msg1, msg2 string, n int) string {
 //     http://www.gnu.org/software/gettext/manual/gettext.html#MO-Files
 //
 // TODO: check if the format version is supported
-// TODO: parse file header; specially Content-Type and Plural-Forms values.
 func (c *Catalog) ReadMO(r Reader) error {
 	// First word identifies the byte order.
 	var order binary.ByteOrder
@@ -174,18 +272,16 @@ func (c *Catalog) ReadMO(r Reader) error {
 		tTableIdx += 8
 		mStr, tStr := string(m), string(t)
 		if mStr == "" {
-			// TODO: this is the file header. Parse it.
+			c.parseHeader(tStr)
 			continue
 		}
-		// Check for context.
-		ctx := ""
+		// Check for context. Context-qualified messages are stored under
+		// their "ctx\x04msg" key, alongside the unqualified ones, so a
+		// single catalog can serve Gettext and Pgettext lookups at once.
+		ctxPrefix := ""
 		if cIdx := strings.Index(mStr, "\x04"); cIdx != -1 {
-			ctx = mStr[:cIdx]
+			ctxPrefix = mStr[:cIdx+1]
 			mStr = mStr[cIdx+1:]
-			if c.ContextFunc != nil && !c.ContextFunc(ctx) {
-				// Context is not valid.
-				continue
-			}
 		}
 		// Check for plurals.
 		if pIdx := strings.Index(mStr, "\x00"); pIdx != -1 {
@@ -193,17 +289,37 @@ func (c *Catalog) ReadMO(r Reader) error {
 			// in the messages map, and all plural forms in the plurals map.
 			mPlurals := strings.Split(mStr, "\x00")
 			tPlurals := strings.Split(tStr, "\x00")
-			mStr = mPlurals[0]
-			c.messages[mStr] = tPlurals[0]
-			c.mPlurals[mStr] = mPlurals
-			c.tPlurals[mStr] = tPlurals
+			key := ctxPrefix + mPlurals[0]
+			c.messages[key] = tPlurals[0]
+			c.mPlurals[key] = mPlurals
+			c.tPlurals[key] = tPlurals
 		} else {
-			c.messages[mStr] = tStr
+			c.messages[ctxPrefix+mStr] = tStr
 		}
 	}
+	c.transcodeToUTF8()
 	return nil
 }
 
-func parsePluralForms(expr string) pluralFunc {
-	return nil
+// parseHeader parses the empty-msgid header entry, a sequence of
+// "Key: value" lines, into c.header. It also wires up c.pluralFunc from
+// the Plural-Forms entry, if present and valid.
+func (c *Catalog) parseHeader(header string) {
+	for _, line := range strings.Split(header, "\n") {
+		idx := strings.Index(line, ":")
+		if idx < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:idx])
+		value := strings.TrimSpace(line[idx+1:])
+		if key == "" {
+			continue
+		}
+		c.header[key] = value
+	}
+	if forms, ok := c.header["Plural-Forms"]; ok {
+		if _, fn, err := parsePluralForms(forms); err == nil {
+			c.pluralFunc = fn
+		}
+	}
 }
@@ -0,0 +1,118 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettext
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"testing"
+)
+
+// buildMO encodes entries as a minimal little-endian MO file. entries[0]
+// must be the header entry, i.e. have an empty id. id and str may each
+// hold "\x00"-joined plural forms.
+func buildMO(entries [][2]string) []byte {
+	n := uint32(len(entries))
+	const headerLen = 28
+	origTableOff := uint32(headerLen)
+	transTableOff := origTableOff + n*8
+	dataOff := transTableOff + n*8
+
+	var origTable, transTable, data bytes.Buffer
+	offset := dataOff
+	for _, e := range entries {
+		b := []byte(e[0])
+		binary.Write(&origTable, binary.LittleEndian, uint32(len(b)))
+		binary.Write(&origTable, binary.LittleEndian, offset)
+		data.Write(b)
+		data.WriteByte(0)
+		offset += uint32(len(b)) + 1
+	}
+	for _, e := range entries {
+		b := []byte(e[1])
+		binary.Write(&transTable, binary.LittleEndian, uint32(len(b)))
+		binary.Write(&transTable, binary.LittleEndian, offset)
+		data.Write(b)
+		data.WriteByte(0)
+		offset += uint32(len(b)) + 1
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(magicLittleEndian))
+	binary.Write(&buf, binary.LittleEndian, uint32(0)) // format revision
+	binary.Write(&buf, binary.LittleEndian, n)
+	binary.Write(&buf, binary.LittleEndian, origTableOff)
+	binary.Write(&buf, binary.LittleEndian, transTableOff)
+	binary.Write(&buf, binary.LittleEndian, uint32(0)) // hash table size
+	binary.Write(&buf, binary.LittleEndian, uint32(0)) // hash table offset
+	buf.Write(origTable.Bytes())
+	buf.Write(transTable.Bytes())
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
+
+// TestReadMOPlurals builds an in-memory MO file per language and checks
+// that Ngettext selects the plural form GNU gettext's own Plural-Forms
+// rule would select, for a range of n that exercises every branch of
+// each rule.
+func TestReadMOPlurals(t *testing.T) {
+	tests := []struct {
+		locale      string
+		pluralForms string
+		wantIdxForN map[int]int
+	}{
+		{
+			locale:      "en",
+			pluralForms: "nplurals=2; plural=n != 1;",
+			wantIdxForN: map[int]int{0: 1, 1: 0, 2: 1, 5: 1, 11: 1, 21: 1},
+		},
+		{
+			locale:      "pl",
+			pluralForms: "nplurals=3; plural=(n==1 ? 0 : n%10>=2 && n%10<=4 && (n%100<10 || n%100>=20) ? 1 : 2);",
+			wantIdxForN: map[int]int{1: 0, 2: 1, 5: 2, 12: 2, 22: 1, 25: 2},
+		},
+		{
+			locale:      "ru",
+			pluralForms: "nplurals=3; plural=(n%10==1 && n%100!=11 ? 0 : n%10>=2 && n%10<=4 && (n%100<10 || n%100>=20) ? 1 : 2);",
+			wantIdxForN: map[int]int{1: 0, 2: 1, 5: 2, 11: 2, 21: 0, 22: 1, 25: 2},
+		},
+	}
+	for _, tc := range tests {
+		nplurals := 2
+		if tc.locale != "en" {
+			nplurals = 3
+		}
+		forms := make([]string, nplurals)
+		for i := range forms {
+			forms[i] = "idx" + strconv.Itoa(i)
+		}
+		header := "Content-Type: text/plain; charset=UTF-8\nPlural-Forms: " + tc.pluralForms + "\n"
+		mStr := "apple\x00apples"
+		tStr := ""
+		for i, f := range forms {
+			if i > 0 {
+				tStr += "\x00"
+			}
+			tStr += f
+		}
+		mo := buildMO([][2]string{
+			{"", header},
+			{mStr, tStr},
+		})
+
+		c := NewCatalog()
+		if err := c.ReadMO(bytes.NewReader(mo)); err != nil {
+			t.Fatalf("%s: ReadMO failed: %v", tc.locale, err)
+		}
+		for n, wantIdx := range tc.wantIdxForN {
+			got := c.Ngettext("apple", "apples", n)
+			want := forms[wantIdx]
+			if got != want {
+				t.Fatalf("%s: Ngettext(%q, %q, %d) = %q, want %q", tc.locale, "apple", "apples", n, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,384 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettext
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// parsePluralForms extracts nplurals and the plural expression from the
+// value of a "Plural-Forms" header, e.g.:
+//
+//     nplurals=2; plural=n != 1;
+//
+// and compiles the expression into a pluralFunc that evaluates it for a
+// given n, clamping the result into [0, nplurals).
+func parsePluralForms(value string) (nplurals int, fn pluralFunc, err error) {
+	nplurals = -1
+	var exprStr string
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "nplurals":
+			n, err2 := strconv.Atoi(val)
+			if err2 != nil {
+				return 0, nil, errors.New("gettext: invalid nplurals in Plural-Forms header: " + val)
+			}
+			nplurals = n
+		case "plural":
+			exprStr = val
+		}
+	}
+	if nplurals < 0 {
+		return 0, nil, errors.New("gettext: missing nplurals in Plural-Forms header")
+	}
+	if exprStr == "" {
+		return 0, nil, errors.New("gettext: missing plural expression in Plural-Forms header")
+	}
+	expr, err := parsePluralExpr(exprStr)
+	if err != nil {
+		return 0, nil, err
+	}
+	n := nplurals
+	return nplurals, func(i int) int {
+		idx := expr.eval(i)
+		if idx < 0 {
+			idx = 0
+		} else if idx >= n {
+			idx = n - 1
+		}
+		return idx
+	}, nil
+}
+
+// ----------------------------------------------------------------------------
+// Plural expression AST
+// ----------------------------------------------------------------------------
+
+// pluralExpr is a node in the parsed plural expression AST. It evaluates
+// to 0 or 1 for boolean operators (C semantics) and to an arbitrary int
+// for arithmetic and the ternary operator.
+type pluralExpr interface {
+	eval(n int) int
+}
+
+type pluralNum int
+
+func (e pluralNum) eval(n int) int { return int(e) }
+
+type pluralVar struct{}
+
+func (pluralVar) eval(n int) int { return n }
+
+type pluralUnary struct {
+	x pluralExpr
+}
+
+func (e pluralUnary) eval(n int) int {
+	if e.x.eval(n) == 0 {
+		return 1
+	}
+	return 0
+}
+
+type pluralBinary struct {
+	op   string
+	l, r pluralExpr
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (e pluralBinary) eval(n int) int {
+	l := e.l.eval(n)
+	switch e.op {
+	case "||":
+		if l != 0 {
+			return 1
+		}
+		return boolToInt(e.r.eval(n) != 0)
+	case "&&":
+		if l == 0 {
+			return 0
+		}
+		return boolToInt(e.r.eval(n) != 0)
+	}
+	r := e.r.eval(n)
+	switch e.op {
+	case "==":
+		return boolToInt(l == r)
+	case "!=":
+		return boolToInt(l != r)
+	case "<":
+		return boolToInt(l < r)
+	case "<=":
+		return boolToInt(l <= r)
+	case ">":
+		return boolToInt(l > r)
+	case ">=":
+		return boolToInt(l >= r)
+	case "+":
+		return l + r
+	case "-":
+		return l - r
+	case "*":
+		return l * r
+	case "/":
+		if r == 0 {
+			return 0
+		}
+		return l / r
+	case "%":
+		if r == 0 {
+			return 0
+		}
+		return l % r
+	}
+	panic("gettext: unknown plural operator " + e.op)
+}
+
+type pluralCond struct {
+	cond, then, els pluralExpr
+}
+
+func (e pluralCond) eval(n int) int {
+	if e.cond.eval(n) != 0 {
+		return e.then.eval(n)
+	}
+	return e.els.eval(n)
+}
+
+// ----------------------------------------------------------------------------
+// Tokenizer
+// ----------------------------------------------------------------------------
+
+type pluralTokKind int
+
+const (
+	pluralTokEOF pluralTokKind = iota
+	pluralTokNumber
+	pluralTokIdent
+	pluralTokOp
+)
+
+type pluralTok struct {
+	kind pluralTokKind
+	text string
+}
+
+func tokenizePluralExpr(s string) ([]pluralTok, error) {
+	var toks []pluralTok
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			toks = append(toks, pluralTok{pluralTokNumber, s[i:j]})
+			i = j
+		case c == 'n':
+			toks = append(toks, pluralTok{pluralTokIdent, "n"})
+			i++
+		case strings.HasPrefix(s[i:], "&&"), strings.HasPrefix(s[i:], "||"),
+			strings.HasPrefix(s[i:], "=="), strings.HasPrefix(s[i:], "!="),
+			strings.HasPrefix(s[i:], "<="), strings.HasPrefix(s[i:], ">="):
+			toks = append(toks, pluralTok{pluralTokOp, s[i : i+2]})
+			i += 2
+		case strings.ContainsRune("+-*/%<>!?:()", rune(c)):
+			toks = append(toks, pluralTok{pluralTokOp, s[i : i+1]})
+			i++
+		default:
+			return nil, errors.New("gettext: unexpected character " + string(c) + " in plural expression")
+		}
+	}
+	toks = append(toks, pluralTok{kind: pluralTokEOF})
+	return toks, nil
+}
+
+// ----------------------------------------------------------------------------
+// Recursive-descent parser
+//
+// Grammar, from lowest to highest precedence (standard C precedence,
+// left-associative except the right-associative ternary):
+//
+//	ternary  -> logicOr ( "?" ternary ":" ternary )?
+//	logicOr  -> logicAnd ( "||" logicAnd )*
+//	logicAnd -> equality ( "&&" equality )*
+//	equality -> relational ( ("==" | "!=") relational )*
+//	relational -> additive ( ("<" | "<=" | ">" | ">=") additive )*
+//	additive -> multiplicative ( ("+" | "-") multiplicative )*
+//	multiplicative -> unary ( ("*" | "/" | "%") unary )*
+//	unary    -> "!" unary | primary
+//	primary  -> number | "n" | "(" ternary ")"
+// ----------------------------------------------------------------------------
+
+type pluralParser struct {
+	toks []pluralTok
+	pos  int
+}
+
+func parsePluralExpr(s string) (pluralExpr, error) {
+	toks, err := tokenizePluralExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &pluralParser{toks: toks}
+	expr, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != pluralTokEOF {
+		return nil, errors.New("gettext: unexpected trailing input in plural expression")
+	}
+	return expr, nil
+}
+
+func (p *pluralParser) peek() pluralTok { return p.toks[p.pos] }
+
+func (p *pluralParser) advance() pluralTok {
+	t := p.toks[p.pos]
+	if p.pos < len(p.toks)-1 {
+		p.pos++
+	}
+	return t
+}
+
+func (p *pluralParser) consumeOp(op string) bool {
+	if p.peek().kind == pluralTokOp && p.peek().text == op {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *pluralParser) parseTernary() (pluralExpr, error) {
+	cond, err := p.parseLogicOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.consumeOp("?") {
+		return cond, nil
+	}
+	then, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if !p.consumeOp(":") {
+		return nil, errors.New("gettext: expected ':' in plural expression")
+	}
+	els, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	return pluralCond{cond, then, els}, nil
+}
+
+func (p *pluralParser) parseBinaryLevel(ops []string, next func() (pluralExpr, error)) (pluralExpr, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		matched := ""
+		if p.peek().kind == pluralTokOp {
+			for _, op := range ops {
+				if p.peek().text == op {
+					matched = op
+					break
+				}
+			}
+		}
+		if matched == "" {
+			return left, nil
+		}
+		p.advance()
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = pluralBinary{matched, left, right}
+	}
+}
+
+func (p *pluralParser) parseLogicOr() (pluralExpr, error) {
+	return p.parseBinaryLevel([]string{"||"}, p.parseLogicAnd)
+}
+
+func (p *pluralParser) parseLogicAnd() (pluralExpr, error) {
+	return p.parseBinaryLevel([]string{"&&"}, p.parseEquality)
+}
+
+func (p *pluralParser) parseEquality() (pluralExpr, error) {
+	return p.parseBinaryLevel([]string{"==", "!="}, p.parseRelational)
+}
+
+func (p *pluralParser) parseRelational() (pluralExpr, error) {
+	return p.parseBinaryLevel([]string{"<=", ">=", "<", ">"}, p.parseAdditive)
+}
+
+func (p *pluralParser) parseAdditive() (pluralExpr, error) {
+	return p.parseBinaryLevel([]string{"+", "-"}, p.parseMultiplicative)
+}
+
+func (p *pluralParser) parseMultiplicative() (pluralExpr, error) {
+	return p.parseBinaryLevel([]string{"*", "/", "%"}, p.parseUnary)
+}
+
+func (p *pluralParser) parseUnary() (pluralExpr, error) {
+	if p.consumeOp("!") {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return pluralUnary{x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *pluralParser) parsePrimary() (pluralExpr, error) {
+	tok := p.peek()
+	switch {
+	case tok.kind == pluralTokNumber:
+		p.advance()
+		v, err := strconv.Atoi(tok.text)
+		if err != nil {
+			return nil, errors.New("gettext: invalid integer " + tok.text + " in plural expression")
+		}
+		return pluralNum(v), nil
+	case tok.kind == pluralTokIdent && tok.text == "n":
+		p.advance()
+		return pluralVar{}, nil
+	case tok.kind == pluralTokOp && tok.text == "(":
+		p.advance()
+		expr, err := p.parseTernary()
+		if err != nil {
+			return nil, err
+		}
+		if !p.consumeOp(")") {
+			return nil, errors.New("gettext: expected ')' in plural expression")
+		}
+		return expr, nil
+	}
+	return nil, errors.New("gettext: unexpected token in plural expression: " + tok.text)
+}
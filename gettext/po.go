@@ -0,0 +1,251 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettext
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// poEntry accumulates the fields of a single PO entry while it is being
+// parsed, before it is flushed into the catalog's maps.
+type poEntry struct {
+	fuzzy      bool
+	ctx        string
+	id         string
+	idPlural   string
+	hasPlural  bool
+	str        string
+	strPlurals map[int]string
+}
+
+func newPOEntry() *poEntry {
+	return &poEntry{strPlurals: make(map[int]string)}
+}
+
+// ReadPO reads a GNU PO file and writes its messages and translations to
+// the catalog, mirroring the maps that ReadMO populates.
+//
+// PO format reference:
+//
+//	http://www.gnu.org/software/gettext/manual/gettext.html#PO-Files
+//
+// Entries marked "#, fuzzy" are skipped unless c.IncludeFuzzy is true.
+func (c *Catalog) ReadPO(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	entry := newPOEntry()
+	// field is the PO keyword the parser is currently accumulating string
+	// continuation lines for: "", "msgctxt", "msgid", "msgid_plural",
+	// "msgstr", or "msgstr[]" for any msgstr[N] (N kept in strIdx).
+	field := ""
+	strIdx := 0
+	flush := func() error {
+		if entry.id == "" && entry.str == "" && len(entry.strPlurals) == 0 {
+			// Nothing was parsed into this entry; e.g. a run of blank lines.
+			entry = newPOEntry()
+			return nil
+		}
+		if entry.fuzzy && !c.IncludeFuzzy {
+			entry = newPOEntry()
+			return nil
+		}
+		if entry.id == "" {
+			c.parseHeader(entry.str)
+			entry = newPOEntry()
+			return nil
+		}
+		key := entry.id
+		if entry.ctx != "" {
+			key = contextKey(entry.ctx, entry.id)
+		}
+		if entry.hasPlural {
+			mPlurals := []string{entry.id, entry.idPlural}
+			n := len(entry.strPlurals)
+			tPlurals := make([]string, n)
+			for i := 0; i < n; i++ {
+				tPlurals[i] = entry.strPlurals[i]
+			}
+			c.messages[key] = tPlurals[0]
+			c.mPlurals[key] = mPlurals
+			c.tPlurals[key] = tPlurals
+		} else {
+			c.messages[key] = entry.str
+		}
+		entry = newPOEntry()
+		return nil
+	}
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			if err := flush(); err != nil {
+				return err
+			}
+			field = ""
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			if strings.HasPrefix(line, "#,") && strings.Contains(line, "fuzzy") {
+				entry.fuzzy = true
+			}
+			continue
+		}
+		if line[0] == '"' {
+			s, err := unescapePOString(line)
+			if err != nil {
+				return err
+			}
+			switch field {
+			case "msgctxt":
+				entry.ctx += s
+			case "msgid":
+				entry.id += s
+			case "msgid_plural":
+				entry.idPlural += s
+			case "msgstr":
+				entry.str += s
+			case "msgstr[]":
+				entry.strPlurals[strIdx] += s
+			default:
+				return errors.New("gettext: PO string continuation outside of a keyword")
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "msgctxt"):
+			field = "msgctxt"
+			s, err := poKeywordValue(line, "msgctxt")
+			if err != nil {
+				return err
+			}
+			entry.ctx = s
+		case strings.HasPrefix(line, "msgid_plural"):
+			field = "msgid_plural"
+			s, err := poKeywordValue(line, "msgid_plural")
+			if err != nil {
+				return err
+			}
+			entry.idPlural = s
+			entry.hasPlural = true
+		case strings.HasPrefix(line, "msgid"):
+			field = "msgid"
+			s, err := poKeywordValue(line, "msgid")
+			if err != nil {
+				return err
+			}
+			entry.id = s
+		case strings.HasPrefix(line, "msgstr["):
+			end := strings.Index(line, "]")
+			if end < 0 {
+				return errors.New("gettext: malformed msgstr[N] in PO file")
+			}
+			idx, err := strconv.Atoi(line[len("msgstr["):end])
+			if err != nil {
+				return errors.New("gettext: malformed msgstr[N] in PO file")
+			}
+			strIdx = idx
+			field = "msgstr[]"
+			s, err := poKeywordValue(line, line[:end+1])
+			if err != nil {
+				return err
+			}
+			entry.strPlurals[strIdx] = s
+		case strings.HasPrefix(line, "msgstr"):
+			field = "msgstr"
+			s, err := poKeywordValue(line, "msgstr")
+			if err != nil {
+				return err
+			}
+			entry.str = s
+		default:
+			return errors.New("gettext: unrecognized PO line: " + line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	c.transcodeToUTF8()
+	return nil
+}
+
+// poKeywordValue returns the unescaped quoted string value following a PO
+// keyword, e.g. poKeywordValue(`msgid "foo"`, "msgid") returns "foo".
+func poKeywordValue(line, keyword string) (string, error) {
+	rest := strings.TrimSpace(line[len(keyword):])
+	if rest == "" {
+		return "", nil
+	}
+	return unescapePOString(rest)
+}
+
+// unescapePOString decodes a single C-style quoted PO string literal,
+// including \n, \t, \", \\, \xHH and \OOO escapes.
+func unescapePOString(s string) (string, error) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return "", errors.New("gettext: malformed quoted string in PO file: " + s)
+	}
+	s = s[1 : len(s)-1]
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			out = append(out, c)
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return "", errors.New("gettext: trailing backslash in PO string")
+		}
+		switch s[i] {
+		case 'n':
+			out = append(out, '\n')
+		case 't':
+			out = append(out, '\t')
+		case 'r':
+			out = append(out, '\r')
+		case '"':
+			out = append(out, '"')
+		case '\\':
+			out = append(out, '\\')
+		case 'x':
+			j := i + 1
+			for j < len(s) && j < i+3 && isHexDigit(s[j]) {
+				j++
+			}
+			if j == i+1 {
+				return "", errors.New("gettext: malformed \\x escape in PO string")
+			}
+			v, err := strconv.ParseUint(s[i+1:j], 16, 8)
+			if err != nil {
+				return "", errors.New("gettext: malformed \\x escape in PO string")
+			}
+			out = append(out, byte(v))
+			i = j - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			j := i
+			for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+				j++
+			}
+			v, err := strconv.ParseUint(s[i:j], 8, 8)
+			if err != nil {
+				return "", errors.New("gettext: malformed octal escape in PO string")
+			}
+			out = append(out, byte(v))
+			i = j - 1
+		default:
+			out = append(out, s[i])
+		}
+	}
+	return string(out), nil
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}